@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+)
+
+// Filter holds the backend-agnostic query filtering parameters that are
+// assembled from flags by currentFilter() for each query and handed to
+// whichever LogBackend is selected via -backend.
+type Filter struct {
+	FixedString     string
+	RegexString     string
+	AdditionalWhere string
+	Before          string
+	After           string
+	Fields          string
+	TextField       string
+	Table           string
+
+	Offset uint
+
+	// HasCursor, CursorDate and CursorMillis come from -cursor: an opaque
+	// (date, millis) resume point for the row the previous run last
+	// emitted, stable across inserts unlike -offset.
+	HasCursor    bool
+	CursorDate   string
+	CursorMillis int
+}
+
+// Sort controls the chronological ordering of results.
+type Sort struct {
+	Reverse bool
+}
+
+// LineStream is a reader of result lines in the "date\tmillis\trest..."
+// tab-separated format consumed by printResults, regardless of which
+// backend actually produced them.
+type LineStream = *bufio.Reader
+
+// LogBackend abstracts the log store being queried so that the rest of the
+// CLI -- -B/-A/-C context, -tailf, -reverse, -limit -- works the same no
+// matter where the logs actually live.
+type LogBackend interface {
+	// Search runs the main query and streams back matching lines. progress,
+	// if non-nil, is called with periodic progress updates while the query
+	// runs; backends that can't report progress may ignore it.
+	Search(ctx context.Context, f Filter, s Sort, limit uint, progress ProgressFunc) (LineStream, error)
+
+	// Context fetches numLines of context before (isBefore) or after the
+	// given timestamp, to satisfy -B/-A/-C. f carries the table/fields that
+	// identify where and what to read, the same Filter passed to Search.
+	Context(ctx context.Context, f Filter, date string, millis int, isBefore bool, s Sort, numLines uint) (LineStream, error)
+}
+
+// newBackend constructs the LogBackend selected by -backend.
+func newBackend(name string) (LogBackend, error) {
+	switch name {
+	case "", "clickhouse":
+		return &ClickHouseBackend{Addr: *chAddr}, nil
+	case "elasticsearch", "es":
+		return &ElasticsearchBackend{Addr: *esAddr, Index: *esIndex}, nil
+	default:
+		return nil, fmt.Errorf("unknown -backend %q (want clickhouse or elasticsearch)", name)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClickHouseBackend is the original, and default, LogBackend: it talks to a
+// ClickHouse HTTP endpoint and streams back TabSeparatedRaw rows.
+type ClickHouseBackend struct {
+	Addr string
+}
+
+// Progress describes ClickHouse query progress result.
+type Progress struct {
+	ReadRows        int64 `json:"read_rows,string"`
+	ReadBytes       int64 `json:"read_bytes,string"`
+	WrittenRows     int64 `json:"written_rows,string"`
+	WrittenBytes    int64 `json:"written_bytes,string"`
+	TotalRowsToRead int64 `json:"total_rows_to_read,string"`
+}
+
+// makeFilterConds builds the WHERE clauses for f/s, registering any user
+// values (search text, dates, cursor) with qb so they travel as
+// param_<name>=... URL parameters instead of being escaped into the query
+// text. f.TextField is an identifier, not a value, so it's validated against
+// allowed rather than parameterized (ClickHouse has no placeholder for column
+// names).
+func makeFilterConds(f Filter, s Sort, qb *queryBuilder, allowed map[string]bool) ([]string, error) {
+	var conds []string
+
+	conds = append(conds, "1=1")
+
+	if f.AdditionalWhere != "" {
+		conds = append(conds, "("+f.AdditionalWhere+")")
+	}
+
+	if f.FixedString != "" || f.RegexString != "" {
+		if err := validateIdent(f.TextField, allowed); err != nil {
+			return nil, err
+		}
+	}
+
+	if f.FixedString != "" {
+		conds = append(conds, `position(`+f.TextField+`, `+qb.param("String", f.FixedString)+`) <> 0`)
+	}
+
+	if f.RegexString != "" {
+		conds = append(conds, `match(`+f.TextField+`, `+qb.param("String", f.RegexString)+`) = 1`)
+	}
+
+	if f.Before != "" {
+		conds = append(conds, `time < `+qb.param("DateTime", f.Before))
+	}
+
+	if f.After != "" {
+		conds = append(conds, `time > `+qb.param("DateTime", f.After))
+	}
+
+	if f.HasCursor {
+		comparison := "<"
+		if !s.Reverse {
+			comparison = ">"
+		}
+		conds = append(conds, fmt.Sprintf(`(time, millis) %s (%s, %s)`,
+			comparison, qb.param("DateTime", f.CursorDate), qb.param("UInt32", strconv.Itoa(f.CursorMillis))))
+	}
+
+	return conds, nil
+}
+
+// Context fetches numLines of context before or after the given timestamp
+// by running a small ORDER BY/LIMIT query around (date, millis).
+func (b *ClickHouseBackend) Context(ctx context.Context, f Filter, date string, millis int, isBefore bool, s Sort, numLines uint) (LineStream, error) {
+	start := time.Now()
+
+	comparison := "<"
+	desc := " DESC"
+
+	if s.Reverse && isBefore || !isBefore && !s.Reverse {
+		comparison = ">"
+		desc = ""
+	}
+
+	allowed := allowedIdents(f)
+	if err := validateIdents(f.Table, f.Fields, allowed); err != nil {
+		return nil, err
+	}
+
+	qb := newQueryBuilder()
+	dateParam := qb.param("DateTime", date)
+	millisParam := qb.param("UInt32", strconv.Itoa(millis))
+
+	query := fmt.Sprintf(`SELECT time,millis,%s FROM %s
+		WHERE (time = %s AND millis %s %s) OR (time %s %s)
+		ORDER BY time%s, millis%s
+		LIMIT %d
+		SETTINGS max_threads=1
+		FORMAT TabSeparatedRaw`,
+		f.Fields, f.Table,
+		dateParam, comparison, millisParam, comparison, dateParam,
+		desc, desc,
+		numLines)
+
+	if *debug {
+		fmt.Printf("Context query: %s (params: %v)\n", query, qb.params)
+	}
+
+	u := qb.params
+	u.Set("query", query)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+b.Addr+"/?"+u.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	allLines, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	res := strings.Split(strings.TrimSpace(string(allLines)), "\n")
+
+	// reverse the result if context sorting does not match the desired
+	// sorting
+	if desc == "" && s.Reverse || desc != "" && !s.Reverse {
+		for i := 0; i < len(res)/2; i++ {
+			res[i], res[len(res)-i-1] = res[len(res)-i-1], res[i]
+		}
+	}
+
+	if *debug {
+		fmt.Printf("(context calculated for %s) ", time.Since(start))
+	}
+
+	return bufio.NewReader(strings.NewReader(strings.Join(res, "\n") + "\n")), nil
+}
+
+// killQuery asks the ClickHouse server to stop running queryID. It is used
+// as a follow-up once the client gives up on a query, since closing our end
+// of the TCP connection does not reliably stop server-side work.
+func (b *ClickHouseBackend) killQuery(queryID string) {
+	u := url.Values{}
+	u.Set("query", fmt.Sprintf("KILL QUERY WHERE query_id = '%s' SYNC", queryID))
+
+	killCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(killCtx, http.MethodPost, "http://"+b.Addr+"/?"+u.Encode(), nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to cancel query %s server-side: %v\n", queryID, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// doneOnEOF wraps a net.Conn and closes done the first time Read returns an
+// error (normally io.EOF once the caller has consumed the whole body), so
+// that code watching done knows the connection is no longer being read from.
+type doneOnEOF struct {
+	net.Conn
+	done chan struct{}
+	once *sync.Once
+}
+
+func (r doneOnEOF) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	if err != nil {
+		r.once.Do(func() { close(r.done) })
+	}
+	return n, err
+}
+
+// Search runs the main filtered query over the raw ClickHouse HTTP/1.0
+// socket so that progress headers can be read while the query is running,
+// and returns a reader over the TabSeparatedRaw body. Cancelling ctx (via
+// -timeout/-deadline or SIGINT) closes the connection and asks the server
+// to stop the query with a KILL QUERY follow-up.
+func (b *ClickHouseBackend) Search(ctx context.Context, f Filter, s Sort, limit uint, progress ProgressFunc) (LineStream, error) {
+	desc := " DESC"
+	if !s.Reverse {
+		desc = ""
+	}
+
+	limitPart := ""
+	if limit != 0 {
+		limitPart = fmt.Sprintf("LIMIT %d", limit)
+	}
+	if f.Offset != 0 {
+		limitPart += fmt.Sprintf(" OFFSET %d", f.Offset)
+	}
+
+	allowed := allowedIdents(f)
+	if err := validateIdents(f.Table, f.Fields, allowed); err != nil {
+		return nil, err
+	}
+
+	qb := newQueryBuilder()
+	conds, err := makeFilterConds(f, s, qb, allowed)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT time,millis,` + f.Fields + `
+		FROM ` + f.Table + `
+		WHERE ` + strings.Join(conds, " AND ") + `
+		ORDER BY time` + desc + `, millis` + desc + `
+		` + limitPart + `
+		FORMAT TabSeparatedRaw`
+
+	if *debug {
+		fmt.Printf("Executed query: %s (params: %v)\n", query, qb.params)
+	}
+
+	queryID := fmt.Sprintf("logscli-%d-%d", time.Now().UnixNano(), rand.Int63())
+
+	u := qb.params
+	u.Set("cancel_http_readonly_queries_on_client_close", "1")
+	u.Set("send_progress_in_http_headers", "1")
+	u.Set("query_id", queryID)
+	u.Set("query", query)
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", b.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastReadRows atomic.Int64
+	done := make(chan struct{})
+	var doneOnce sync.Once
+	closeDone := func() { doneOnce.Do(func() { close(done) }) }
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			b.killQuery(queryID)
+			fmt.Fprintf(os.Stderr, "%s query cancelled (%v), %d rows read so far\n", clearLine, ctx.Err(), lastReadRows.Load())
+		case <-done:
+		}
+	}()
+
+	// rd is handed back to the caller, which keeps reading the row stream
+	// off conn long after this function returns -- closing done here would
+	// stop the watcher as soon as the header loop below finishes, well
+	// before the body is read, so cancellation would go silently unnoticed
+	// for the rest of the stream. Instead doneOnEOF signals done once the
+	// body read itself ends (EOF or a connection error), at which point ctx
+	// getting cancelled during the caller's later cleanup is a no-op. The
+	// abort helper below covers the other case, where Search itself fails
+	// before ever handing rd back.
+	rd := bufio.NewReader(doneOnEOF{conn, done, &doneOnce})
+	abort := func() {
+		conn.Close()
+		closeDone()
+	}
+
+	wr := bufio.NewWriter(conn)
+	if _, err := fmt.Fprintf(wr, "GET /?%s HTTP/1.0\n\n", u.Encode()); err != nil {
+		abort()
+		return nil, err
+	}
+	if err := wr.Flush(); err != nil {
+		abort()
+		return nil, err
+	}
+
+	for {
+		ln, err := rd.ReadString('\n')
+		if err != nil {
+			abort()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("unexpected error while reading headers: %v", err)
+		}
+		ln = strings.TrimSpace(ln)
+		if ln == "" {
+			break
+		}
+
+		if strings.HasPrefix(ln, "X-ClickHouse-Progress: ") {
+			var p Progress
+			data := strings.TrimPrefix(ln, "X-ClickHouse-Progress: ")
+			if err := json.Unmarshal([]byte(data), &p); err != nil {
+				abort()
+				return nil, fmt.Errorf("unmarshalling %q: %v", data, err)
+			}
+			lastReadRows.Store(p.ReadRows)
+
+			if progress != nil {
+				progress(ProgressUpdate{ReadRows: p.ReadRows, ReadBytes: p.ReadBytes, TotalRows: p.TotalRowsToRead})
+			}
+		}
+	}
+
+	return rd, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// encodeCursor packs (date, millis) of the last row emitted into an opaque,
+// URL-safe token that can be handed back via -cursor to resume a search
+// exactly where it left off, without re-scanning or risking dropped/
+// duplicated rows across inserts the way a plain -after date would.
+func encodeCursor(date string, millis int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(date + "\t" + strconv.Itoa(millis)))
+}
+
+// decodeCursor reverses encodeCursor.
+func decodeCursor(s string) (date string, millis int, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid -cursor: %v", err)
+	}
+
+	parts := strings.SplitN(string(data), "\t", 2)
+	if len(parts) != 2 {
+		return "", 0, fmt.Errorf("invalid -cursor: malformed payload")
+	}
+	date = parts[0]
+
+	millis, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid -cursor: %v", err)
+	}
+
+	return date, millis, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+)
+
+// Deduper suppresses repeated log lines using xxhash of either the whole
+// rendered line or a user-selected subset of its tab-separated fields,
+// similar to syslog's "last message repeated N times". It tracks the
+// currently-running streak exactly (so the repeat count it reports is
+// correct), and additionally merges in near-duplicates that reappear while
+// their hash is still remembered in an LRU of the last -dedup-window
+// recently-closed runs (e.g. a burst of identical stack traces with the
+// occasional different log line interleaved). A remembered hash is
+// one-shot: reusing it to merge a line removes it from the LRU, so it has
+// to close out and be remembered again before it can merge a second time.
+// Without that, a small set of genuinely distinct messages that simply keep
+// alternating (e.g. interleaved health-check/API log lines) would match the
+// LRU forever and vanish instead of printing.
+type Deduper struct {
+	fieldIdx []int // indices into the tab-separated fields to hash, nil for the whole line
+
+	lru      *list.List // recently-closed run hashes, most-recently-remembered at the front
+	index    map[uint64]*list.Element
+	capacity int
+
+	hasRun  bool
+	runHash uint64
+	runLen  uint
+
+	// carry is the count of merged-but-not-yet-reported occurrences: lines
+	// that were suppressed via an LRU hit rather than by extending the
+	// active run, so they have no run of their own to fold their count
+	// into. It's added to flush the next time a run actually closes, so
+	// those occurrences are still accounted for in a reported count.
+	carry uint
+}
+
+// newDeduper builds a Deduper with an LRU of windowSize entries. fieldIdx,
+// if non-empty, holds the indexes of the -fields columns to hash instead of
+// the whole line (see -dedup-fields and dedupFieldIndexes).
+func newDeduper(windowSize uint, fieldIdx []int) *Deduper {
+	return &Deduper{
+		fieldIdx: fieldIdx,
+		lru:      list.New(),
+		index:    make(map[uint64]*list.Element),
+		capacity: int(windowSize),
+	}
+}
+
+// key extracts the bytes a line is deduped on.
+func (d *Deduper) key(rest string) string {
+	if len(d.fieldIdx) == 0 {
+		return rest
+	}
+
+	fieldVals := strings.Split(rest, "\t")
+	picked := make([]string, 0, len(d.fieldIdx))
+	for _, idx := range d.fieldIdx {
+		if idx >= 0 && idx < len(fieldVals) {
+			picked = append(picked, fieldVals[idx])
+		}
+	}
+	return strings.Join(picked, "\t")
+}
+
+// Next records one line and reports whether it should be suppressed as a
+// duplicate. When a new, distinct line ends a run of repeats, flush is the
+// number of additional times the previous line (and any lines merged via
+// the LRU since) repeated and should be printed as "... last message
+// repeated flush times ..." before the current (non-suppressed) line.
+func (d *Deduper) Next(rest string) (flush uint, suppress bool) {
+	h := Sum64String(d.key(rest))
+
+	if d.hasRun && h == d.runHash {
+		d.runLen++
+		return 0, true
+	}
+
+	if e, ok := d.index[h]; ok {
+		d.lru.Remove(e)
+		delete(d.index, h)
+		d.carry++
+		return 0, true
+	}
+
+	if d.hasRun {
+		flush = d.runLen - 1
+		d.remember(d.runHash)
+	}
+
+	flush += d.carry
+	d.carry = 0
+
+	d.hasRun = true
+	d.runHash = h
+	d.runLen = 1
+
+	return flush, false
+}
+
+// Flush returns the number of additional repeats of any run still in
+// progress, plus any merged occurrences not yet folded into a reported
+// count, for callers to report once the input is exhausted.
+func (d *Deduper) Flush() uint {
+	extra := d.carry
+	d.carry = 0
+
+	if d.hasRun && d.runLen >= 2 {
+		extra += d.runLen - 1
+	}
+
+	return extra
+}
+
+// remember makes h available to merge a future near-duplicate, evicting the
+// least-recently-remembered hash if the LRU is over capacity.
+func (d *Deduper) remember(h uint64) {
+	if d.capacity == 0 {
+		return
+	}
+
+	d.index[h] = d.lru.PushFront(h)
+
+	if d.lru.Len() > d.capacity {
+		back := d.lru.Back()
+		delete(d.index, back.Value.(uint64))
+		d.lru.Remove(back)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ElasticsearchBackend implements LogBackend against an Elasticsearch (or
+// compatible) HTTP endpoint. It paginates the main search with a Point In
+// Time (PIT) and search_after rather than from/size, since from/size is
+// capped by index.max_result_window and gets slower the deeper a search
+// page goes; PIT+search_after stays cheap however far the stream runs.
+type ElasticsearchBackend struct {
+	Addr  string
+	Index string
+}
+
+// esTimeLayout matches the "YYYY-MM-DD HH:MM:SS" rendering used elsewhere in
+// the CLI (e.g. ClickHouse's DateTime), so that lines from either backend
+// look the same to printResults and to -cursor/-after.
+const esTimeLayout = "2006-01-02 15:04:05"
+
+// toESTime converts a timestamp in esTimeLayout -- what -before/-after/
+// -cursor and the context lookups all carry, since that's the one wire
+// format both backends agree on -- back into RFC3339 before it goes into an
+// ES query, since a default ES date mapping (strict_date_optional_time)
+// rejects the space-separated layout. Left unchanged if it doesn't parse as
+// esTimeLayout, so a value that's already RFC3339 still works.
+func toESTime(s string) string {
+	t, err := time.Parse(esTimeLayout, s)
+	if err != nil {
+		return s
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+type esHit struct {
+	Sort   []interface{}          `json:"sort"`
+	Source map[string]interface{} `json:"_source"`
+}
+
+type esSearchResponse struct {
+	PitID string `json:"pit_id"`
+	Hits  struct {
+		Hits []esHit `json:"hits"`
+	} `json:"hits"`
+}
+
+func (b *ElasticsearchBackend) buildQuery(f Filter, s Sort) map[string]interface{} {
+	var must []map[string]interface{}
+
+	rng := map[string]interface{}{}
+	if f.After != "" {
+		rng["gt"] = toESTime(f.After)
+	}
+	if f.Before != "" {
+		rng["lt"] = toESTime(f.Before)
+	}
+	if f.HasCursor {
+		// ES's range query can't express the (time, millis) tuple
+		// comparison ClickHouse gets from a composite key, so a -cursor
+		// resume is only as precise as the time field here; millis ties
+		// within the same cursor second can be re-returned.
+		if s.Reverse {
+			rng["lte"] = toESTime(f.CursorDate)
+		} else {
+			rng["gte"] = toESTime(f.CursorDate)
+		}
+	}
+	if len(rng) > 0 {
+		must = append(must, map[string]interface{}{"range": map[string]interface{}{"time": rng}})
+	}
+
+	if f.FixedString != "" {
+		must = append(must, map[string]interface{}{"match": map[string]interface{}{f.TextField: f.FixedString}})
+	}
+
+	if f.RegexString != "" {
+		must = append(must, map[string]interface{}{"regexp": map[string]interface{}{f.TextField: f.RegexString}})
+	}
+
+	if f.AdditionalWhere != "" {
+		must = append(must, map[string]interface{}{"query_string": map[string]interface{}{"query": f.AdditionalWhere}})
+	}
+
+	if len(must) == 0 {
+		return map[string]interface{}{"match_all": map[string]interface{}{}}
+	}
+
+	return map[string]interface{}{"bool": map[string]interface{}{"must": must}}
+}
+
+func esSortOrder(reverse bool) string {
+	if reverse {
+		return "desc"
+	}
+	return "asc"
+}
+
+func (b *ElasticsearchBackend) post(ctx context.Context, path string, body map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+b.Addr+path, &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if *debug {
+		fmt.Printf("ES request: POST %s %s\n", path, buf.String())
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("elasticsearch returned %s: %s", resp.Status, data)
+	}
+
+	return data, nil
+}
+
+func (b *ElasticsearchBackend) openPIT(ctx context.Context) (string, error) {
+	data, err := b.post(ctx, "/"+b.Index+"/_pit?keep_alive=1m", nil)
+	if err != nil {
+		return "", err
+	}
+
+	var out struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return "", fmt.Errorf("unmarshalling PIT response %q: %v", data, err)
+	}
+	return out.ID, nil
+}
+
+func (b *ElasticsearchBackend) closePIT(ctx context.Context, pitID string) {
+	if pitID == "" {
+		return
+	}
+	body := map[string]interface{}{"id": pitID}
+	data, _ := json.Marshal(body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, "http://"+b.Addr+"/_pit", bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// writeHitLine renders one ES hit as a "date\tmillis\trest" line matching
+// what printResults expects from ClickHouse's TabSeparatedRaw output.
+func writeHitLine(buf *bytes.Buffer, h esHit, fieldNames []string) {
+	ts, _ := h.Source["time"].(string)
+	date := ts
+	if t, err := time.Parse(time.RFC3339, ts); err == nil {
+		date = t.UTC().Format(esTimeLayout)
+	}
+
+	millis := 0
+	switch v := h.Source["millis"].(type) {
+	case float64:
+		millis = int(v)
+	}
+
+	fmt.Fprintf(buf, "%s\t%d", date, millis)
+	for _, name := range fieldNames {
+		fmt.Fprintf(buf, "\t%v", h.Source[strings.TrimSpace(name)])
+	}
+	buf.WriteString("\n")
+}
+
+// Search pages through matching documents using a PIT + search_after so
+// that large result sets can be streamed without ES's default 10k-hit
+// window limit.
+// progress is ignored: Elasticsearch's _search API doesn't expose
+// incremental progress the way ClickHouse's HTTP headers do.
+func (b *ElasticsearchBackend) Search(ctx context.Context, f Filter, s Sort, limit uint, progress ProgressFunc) (LineStream, error) {
+	pitID, err := b.openPIT(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer b.closePIT(ctx, pitID)
+
+	fieldNames := strings.Split(f.Fields, ",")
+
+	pageSize := 1000
+	if limit != 0 && uint(pageSize) > limit {
+		pageSize = int(limit)
+	}
+
+	var buf bytes.Buffer
+	var searchAfter []interface{}
+	var total uint
+	skip := f.Offset
+
+	for {
+		body := map[string]interface{}{
+			"size":  pageSize,
+			"query": b.buildQuery(f, s),
+			"pit":   map[string]interface{}{"id": pitID, "keep_alive": "1m"},
+			"sort": []map[string]interface{}{
+				{"time": esSortOrder(s.Reverse)},
+				{"millis": esSortOrder(s.Reverse)},
+			},
+		}
+		if searchAfter != nil {
+			body["search_after"] = searchAfter
+		}
+
+		data, err := b.post(ctx, "/_search", body)
+		if err != nil {
+			return nil, err
+		}
+
+		var sr esSearchResponse
+		if err := json.Unmarshal(data, &sr); err != nil {
+			return nil, fmt.Errorf("unmarshalling search response %q: %v", data, err)
+		}
+
+		if sr.PitID != "" {
+			pitID = sr.PitID
+		}
+
+		if len(sr.Hits.Hits) == 0 {
+			break
+		}
+
+		for _, h := range sr.Hits.Hits {
+			if skip > 0 {
+				skip--
+				continue
+			}
+			writeHitLine(&buf, h, fieldNames)
+			total++
+			if limit != 0 && total >= limit {
+				break
+			}
+		}
+
+		searchAfter = sr.Hits.Hits[len(sr.Hits.Hits)-1].Sort
+
+		if (limit != 0 && total >= limit) || len(sr.Hits.Hits) < pageSize {
+			break
+		}
+	}
+
+	return bufio.NewReader(&buf), nil
+}
+
+// Context fetches numLines of context before or after the given timestamp
+// with a plain range query, sorted the same way ClickHouse's context query
+// is (and reversed afterwards where needed, so the lines come out in the
+// same order as the main results).
+func (b *ElasticsearchBackend) Context(ctx context.Context, f Filter, date string, millis int, isBefore bool, s Sort, numLines uint) (LineStream, error) {
+	order := "desc"
+	rangeOp := "lt"
+	if s.Reverse && isBefore || !isBefore && !s.Reverse {
+		order = "asc"
+		rangeOp = "gt"
+	}
+
+	body := map[string]interface{}{
+		"size":  numLines,
+		"query": map[string]interface{}{"range": map[string]interface{}{"time": map[string]interface{}{rangeOp: toESTime(date)}}},
+		"sort": []map[string]interface{}{
+			{"time": order},
+			{"millis": order},
+		},
+	}
+
+	data, err := b.post(ctx, "/"+b.Index+"/_search", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var sr esSearchResponse
+	if err := json.Unmarshal(data, &sr); err != nil {
+		return nil, fmt.Errorf("unmarshalling context response %q: %v", data, err)
+	}
+
+	hits := sr.Hits.Hits
+	if order == "asc" && s.Reverse || order == "desc" && !s.Reverse {
+		for i := 0; i < len(hits)/2; i++ {
+			hits[i], hits[len(hits)-i-1] = hits[len(hits)-i-1], hits[i]
+		}
+	}
+
+	var buf bytes.Buffer
+	fieldNames := strings.Split(f.Fields, ",")
+	for _, h := range hits {
+		writeHitLine(&buf, h, fieldNames)
+	}
+
+	return bufio.NewReader(&buf), nil
+}
@@ -2,17 +2,12 @@ package main
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"math/rand"
-	"net"
-	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
@@ -44,229 +39,163 @@ var (
 	additionalWhere = flag.String("where", "", `Additional filters in WHERE (e.g. "vine='Y' AND star_rating>4")`)
 	limit           = flag.Uint("limit", 0, "Limit the number of results (0 means no limit)")
 
+	offset    = flag.Uint("offset", 0, "Skip this many matching rows before returning results")
+	cursorArg = flag.String("cursor", "", "Opaque resume cursor (base64), as printed to stderr when -limit is reached; continues exactly after that row instead of re-scanning")
+
 	table  = flag.String("table", "amazon", "The name of the table to scan")
 	chAddr = flag.String("ch-addr", "localhost:8123", "ClickHouse server address (HTTP endpoint)")
 
-	debug = flag.Bool("debug", false, "Whether or not debug mode is enabled")
-)
+	backendName = flag.String("backend", "clickhouse", "Log backend to query: clickhouse or elasticsearch")
+	esAddr      = flag.String("es-addr", "localhost:9200", "Elasticsearch server address (HTTP endpoint)")
+	esIndex     = flag.String("es-index", "logs", "Elasticsearch index (or index pattern) to search")
 
-// Progress describes ClickHouse query progress result.
-type Progress struct {
-	ReadRows        int64 `json:"read_rows,string"`
-	ReadBytes       int64 `json:"read_bytes,string"`
-	WrittenRows     int64 `json:"written_rows,string"`
-	WrittenBytes    int64 `json:"written_bytes,string"`
-	TotalRowsToRead int64 `json:"total_rows_to_read,string"`
-}
+	timeout  = flag.Duration("timeout", 0, "Cancel the query (and tell the server to stop it) after this long, relative to when it starts (0 means no timeout)")
+	deadline = flag.String("deadline", "", "Cancel the query at this absolute time (RFC3339, e.g. 2021-01-02T15:04:05Z); overrides -timeout")
 
-// Escape escapes string for MySQL. It should work for ClickHouse as well.
-func Escape(txt string) string {
-	var (
-		esc string
-		buf bytes.Buffer
-	)
-	last := 0
-	for ii, bb := range txt {
-		switch bb {
-		case 0:
-			esc = `\0`
-		case '\n':
-			esc = `\n`
-		case '\r':
-			esc = `\r`
-		case '\\':
-			esc = `\\`
-		case '\'':
-			esc = `\'`
-		case '"':
-			esc = `\"`
-		case '\032':
-			esc = `\Z`
-		default:
-			continue
-		}
-		io.WriteString(&buf, txt[last:ii])
-		io.WriteString(&buf, esc)
-		last = ii + 1
-	}
-	io.WriteString(&buf, txt[last:])
-	return buf.String()
-}
+	progressMode     = flag.String("progress", "auto", "Progress reporting: auto, tty (human \\r-updating line), json (periodic JSON records) or none")
+	progressInterval = flag.Duration("progress-interval", 500*time.Millisecond, "Minimum time between progress updates")
+
+	dedup       = flag.Bool("dedup", false, "Collapse runs of repeated (or near-duplicate, within -dedup-window) lines into '... last message repeated N times ...'")
+	dedupWindow = flag.Uint("dedup-window", 4096, "How many distinct recent lines -dedup remembers, to catch bursts with the occasional different line interleaved")
+	dedupFields = flag.String("dedup-fields", "", "Comma-separated subset of -fields to dedup on instead of the whole line (e.g. to ignore a timestamp embedded in the text)")
 
-func makeFilterConds() []string {
-	var conds []string
+	sampleN = flag.Uint("sample", 0, "Keep ~1/N of matching lines, chosen deterministically by hash(line) % N == 0 (0 disables sampling)")
 
-	conds = append(conds, "1=1")
+	debug = flag.Bool("debug", false, "Whether or not debug mode is enabled")
+)
 
-	if *additionalWhere != "" {
-		conds = append(conds, "("+(*additionalWhere)+")")
+// dedupFieldIndexes resolves -dedup-fields (names from -fields) to indexes
+// into the tab-separated "rest" of a result line.
+func dedupFieldIndexes() []int {
+	if *dedupFields == "" {
+		return nil
 	}
 
-	if *fixedString != "" {
-		conds = append(conds, `position(`+(*textField)+`, '`+Escape(*fixedString)+`') <> 0`)
+	all := strings.Split(*fields, ",")
+	pos := make(map[string]int, len(all))
+	for i, name := range all {
+		pos[strings.TrimSpace(name)] = i
 	}
 
-	if *regexString != "" {
-		conds = append(conds, `match(`+(*textField)+`, '`+Escape(*regexString)+`') = 1`)
+	var idx []int
+	for _, name := range strings.Split(*dedupFields, ",") {
+		name = strings.TrimSpace(name)
+		i, ok := pos[name]
+		if !ok {
+			log.Fatalf("FATAL error: -dedup-fields %q is not in -fields %q", name, *fields)
+		}
+		idx = append(idx, i)
 	}
+	return idx
+}
 
-	if *before != "" {
-		conds = append(conds, `time < toDateTime('`+Escape(*before)+`')`)
+// queryContext builds the context that governs a single runMain call,
+// applying -deadline (absolute) or -timeout (relative) if set.
+func queryContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if *deadline != "" {
+		t, err := time.Parse(time.RFC3339, *deadline)
+		if err != nil {
+			log.Fatalf("FATAL error: invalid -deadline %q: %v", *deadline, err)
+		}
+		return context.WithDeadline(parent, t)
 	}
 
-	if *after != "" {
-		conds = append(conds, `time > toDateTime('`+Escape(*after)+`')`)
+	if *timeout != 0 {
+		return context.WithTimeout(parent, *timeout)
 	}
 
-	return conds
+	return context.WithCancel(parent)
 }
 
-func printContextResults(date string, millis int, isBefore bool, numLines uint) error {
-	start := time.Now()
-
-	comparison := "<"
-	desc := " DESC"
-
-	if *reverse && isBefore || !isBefore && !*reverse {
-		comparison = ">"
-		desc = ""
+func currentFilter() Filter {
+	f := Filter{
+		FixedString:     *fixedString,
+		RegexString:     *regexString,
+		AdditionalWhere: *additionalWhere,
+		Before:          *before,
+		After:           *after,
+		Fields:          *fields,
+		TextField:       *textField,
+		Table:           *table,
+		Offset:          *offset,
 	}
 
-	query := fmt.Sprintf(`SELECT time,millis,%s FROM %s
-		WHERE (time = '%s' AND millis %s %d) OR (time %s '%s')
-		ORDER BY time%s, millis%s
-		LIMIT %d
-		SETTINGS max_threads=1
-		FORMAT TabSeparatedRaw`,
-		*fields, *table,
-		date, comparison, millis, comparison, date,
-		desc, desc,
-		numLines)
-
-	if *debug {
-		fmt.Printf("Context query: %s\n", query)
+	if *cursorArg != "" {
+		date, millis, err := decodeCursor(*cursorArg)
+		if err != nil {
+			log.Fatalf("FATAL error: %v", err)
+		}
+		f.HasCursor, f.CursorDate, f.CursorMillis = true, date, millis
 	}
 
-	u := url.Values{}
-	u.Set("query", query)
+	return f
+}
 
-	resp, err := http.Get("http://" + (*chAddr) + "/?" + u.Encode())
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+func currentSort() Sort {
+	return Sort{Reverse: *reverse}
+}
 
-	allLines, err := ioutil.ReadAll(resp.Body)
+func printContextResults(ctx context.Context, backend LogBackend, f Filter, date string, millis int, isBefore bool, numLines uint) error {
+	rd, err := backend.Context(ctx, f, date, millis, isBefore, currentSort(), numLines)
 	if err != nil {
 		return err
 	}
 
-	res := strings.Split(strings.TrimSpace(string(allLines)), "\n")
-
-	// reverse the result if context sorting does not match the desired
-	// sorting
-	if desc == "" && *reverse || desc != "" && !*reverse {
-		for i := 0; i < len(res)/2; i++ {
-			res[i], res[len(res)-i-1] = res[len(res)-i-1], res[i]
-		}
-	}
-
-	if *debug {
-		fmt.Printf("(context calculated for %s) ", time.Since(start))
-	}
-
-	_, _, err = printResults(bufio.NewReader(strings.NewReader(strings.Join(res, "\n")+"\n")), false)
+	_, _, _, err = printResults(ctx, backend, f, rd, false, nil)
 	return err
 }
 
-func runMain() (lastDate string, lastMillis int, err error) {
+func runMain(ctx context.Context, backend LogBackend) (lastDate string, lastMillis int, err error) {
 	rand.Seed(time.Now().UnixNano())
 
-	desc := " DESC"
-	if !*reverse {
-		desc = ""
-	}
-
-	limitPart := ""
-	if *limit != 0 {
-		limitPart = fmt.Sprintf("LIMIT %d", *limit)
-	}
-
-	query := `SELECT time,millis,` + (*fields) + `
-		FROM ` + (*table) + `
-		WHERE ` + strings.Join(makeFilterConds(), " AND ") + `
-		ORDER BY time` + desc + `, millis` + desc + `
-		` + limitPart + `
-		FORMAT TabSeparatedRaw`
-
-	if *debug {
-		fmt.Printf("Executed query: %s\n", query)
+	reporter, err := newProgressReporter(*progressMode, *progressInterval)
+	if err != nil {
+		return "", 0, err
 	}
 
-	u := url.Values{}
-	u.Set("cancel_http_readonly_queries_on_client_close", "1")
-	u.Set("send_progress_in_http_headers", "1")
-	u.Set("query", query)
-
-	conn, err := net.Dial("tcp", *chAddr)
+	f := currentFilter()
+	rd, err := backend.Search(ctx, f, currentSort(), *limit, reporter.Report)
+	reporter.Done()
 	if err != nil {
 		return "", 0, err
 	}
-	defer conn.Close()
 
-	rd := bufio.NewReader(conn)
-	wr := bufio.NewWriter(conn)
-	if _, err := fmt.Fprintf(wr, "GET /?%s HTTP/1.0\n\n", u.Encode()); err != nil {
-		return "", 0, err
+	var dd *Deduper
+	if *dedup {
+		dd = newDeduper(*dedupWindow, dedupFieldIndexes())
 	}
-	if err := wr.Flush(); err != nil {
+
+	lastDate, lastMillis, count, err := printResults(ctx, backend, f, rd, true, dd)
+	if err != nil {
 		return "", 0, err
 	}
 
-	start := time.Now()
-
-	for {
-		ln, err := rd.ReadString('\n')
-		if err != nil {
-			return "", 0, fmt.Errorf("unexpected error while reading headers: %v", err)
-		}
-		ln = strings.TrimSpace(ln)
-		if ln == "" {
-			break
-		}
-
-		if strings.HasPrefix(ln, "X-ClickHouse-Progress: ") {
-			var p Progress
-			data := strings.TrimPrefix(ln, "X-ClickHouse-Progress: ")
-			if err := json.Unmarshal([]byte(data), &p); err != nil {
-				return "", 0, fmt.Errorf("unmarshalling %q: %v", data, err)
-			}
-
-			read := float64(p.ReadBytes) / (1 << 30)
-			readPerSec := float64(p.ReadBytes) / (float64(time.Since(start)) / float64(time.Second)) / (1 << 30)
-
-			fmt.Fprintf(os.Stderr, clearLine+"Progress: %.0f%% (read %.2f GiB so far, %.2f GiB/sec)", float64(p.ReadRows)/float64(p.TotalRowsToRead)*100, read, readPerSec)
+	if dd != nil {
+		if n := dd.Flush(); n > 0 {
+			fmt.Printf("... last message repeated %d times ...\n", n)
 		}
 	}
 
-	fmt.Fprintf(os.Stderr, clearLine)
+	if *limit != 0 && count >= *limit && lastDate != "" {
+		fmt.Fprintf(os.Stderr, "Next cursor: -cursor=%s\n", encodeCursor(lastDate, lastMillis))
+	}
 
-	return printResults(rd, true)
+	return lastDate, lastMillis, nil
 }
 
-func printResults(rd *bufio.Reader, printContext bool) (lastDate string, lastMillis int, err error) {
+func printResults(ctx context.Context, backend LogBackend, f Filter, rd *bufio.Reader, printContext bool, dd *Deduper) (lastDate string, lastMillis int, count uint, err error) {
 	for {
 		ln, err := rd.ReadString('\n')
 		if err == io.EOF {
-			return lastDate, lastMillis, nil
+			return lastDate, lastMillis, count, nil
 		} else if err != nil {
-			return "", 0, err
+			return "", 0, 0, err
 		}
 
 		parts := strings.SplitN(ln, "\t", 3)
 		if len(parts) < 3 {
 			if _, err := os.Stdout.WriteString(ln); err != nil {
-				return "", 0, err
+				return "", 0, 0, err
 			}
 			continue
 		}
@@ -276,18 +205,33 @@ func printResults(rd *bufio.Reader, printContext bool) (lastDate string, lastMil
 
 		lastDate = date
 		lastMillis = millis
+		count++
+
+		if printContext && *sampleN != 0 && Sum64String(rest)%uint64(*sampleN) != 0 {
+			continue
+		}
+
+		if printContext && dd != nil {
+			flush, suppress := dd.Next(rest)
+			if flush > 0 {
+				fmt.Printf("... last message repeated %d times ...\n", flush)
+			}
+			if suppress {
+				continue
+			}
+		}
 
 		if printContext && (*beforeLines > 0) {
-			if err := printContextResults(date, millis, true, *beforeLines); err != nil {
-				return "", 0, err
+			if err := printContextResults(ctx, backend, f, date, millis, true, *beforeLines); err != nil {
+				return "", 0, 0, err
 			}
 		}
 
 		fmt.Printf("%s.%03d\t%s\n", date, millis, strings.TrimSpace(strings.ReplaceAll(rest, "\t", " ")))
 
 		if printContext && (*afterLines > 0) {
-			if err := printContextResults(date, millis, false, *afterLines); err != nil {
-				return "", 0, err
+			if err := printContextResults(ctx, backend, f, date, millis, false, *afterLines); err != nil {
+				return "", 0, 0, err
 			}
 		}
 
@@ -296,7 +240,7 @@ func printResults(rd *bufio.Reader, printContext bool) (lastDate string, lastMil
 		}
 	}
 
-	return lastDate, lastMillis, nil
+	return lastDate, lastMillis, count, nil
 }
 
 func main() {
@@ -307,13 +251,40 @@ func main() {
 		*afterLines = *contextLines
 	}
 
-	ch := make(chan os.Signal)
-	signal.Notify(ch, syscall.SIGPIPE)
+	backend, err := newBackend(*backendName)
+	if err != nil {
+		log.Fatalf("FATAL error: %v", err)
+	}
+
+	sigPipe := make(chan os.Signal, 1)
+	signal.Notify(sigPipe, syscall.SIGPIPE)
 	go func() {
-		<-ch
+		<-sigPipe
 		os.Exit(0)
 	}()
 
+	baseCtx, cancel := context.WithCancel(context.Background())
+	sigInt := make(chan os.Signal, 1)
+	signal.Notify(sigInt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigInt
+		fmt.Fprintln(os.Stderr, "\ninterrupted, cancelling query...")
+		cancel()
+	}()
+
+	handleErr := func(err error) {
+		if err == nil {
+			return
+		}
+		if strings.Contains(err.Error(), "broken pipe") {
+			os.Exit(0)
+		}
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			os.Exit(0)
+		}
+		log.Fatalf("FATAL error: %v", err)
+	}
+
 	if *tailF {
 		*reverse = false
 		if *after == "" {
@@ -321,28 +292,28 @@ func main() {
 		}
 
 		for {
-			lastDate, _, err := runMain()
-			if err != nil {
-				if strings.Contains(err.Error(), "broken pipe") {
-					return
-				}
-
-				log.Fatalf("FATAL error: %v", err)
-			}
+			ctx, cancelQuery := queryContext(baseCtx)
+			lastDate, lastMillis, err := runMain(ctx, backend)
+			cancelQuery()
+			handleErr(err)
 
 			if lastDate != "" {
-				*after = lastDate
+				// Resume from the exact (time, millis) of the last row
+				// emitted rather than the second-granularity *after, which
+				// could otherwise duplicate or drop rows sharing that second.
+				// Clear *after so it doesn't keep ANDing its one-time,
+				// pre-loop value into every subsequent query.
+				*after = ""
+				*cursorArg = encodeCursor(lastDate, lastMillis)
 			}
 
 			time.Sleep(time.Second)
 		}
 	}
 
-	if _, _, err := runMain(); err != nil {
-		if strings.Contains(err.Error(), "broken pipe") {
-			return
-		}
+	ctx, cancelQuery := queryContext(baseCtx)
+	defer cancelQuery()
 
-		log.Fatalf("FATAL error: %v", err)
-	}
+	_, _, err = runMain(ctx, backend)
+	handleErr(err)
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ProgressUpdate is a backend-agnostic snapshot of query progress, reported
+// as often as a backend can produce one.
+type ProgressUpdate struct {
+	ReadRows  int64
+	ReadBytes int64
+	TotalRows int64
+}
+
+// ProgressFunc receives progress updates while a backend's Search is
+// running. It may be called from the goroutine driving the query.
+type ProgressFunc func(ProgressUpdate)
+
+// isTerminal reports whether f is connected to a terminal, to decide
+// between the human \r-updating progress line and JSON progress records.
+// This only checks for a character device rather than doing an actual
+// ioctl, so it can misfire on something like /dev/null, but it's portable
+// across the platforms logscli builds for, unlike a raw TCGETS syscall.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// ProgressReporter formats progress updates for a human (a single
+// \r-updating line with ETA and smoothed throughput, on a TTY) or for a
+// script (periodic JSON records, when stderr isn't a TTY or -progress=json
+// is forced).
+type ProgressReporter struct {
+	none     bool
+	json     bool
+	interval time.Duration
+
+	lastPrint  time.Time
+	lastSample time.Time
+	lastBytes  int64
+	lastRows   int64
+	byteRate   float64
+	rowRate    float64
+}
+
+// newProgressReporter builds a reporter for the given -progress mode,
+// resolving "auto" based on whether stderr is a terminal. "none" returns a
+// reporter whose Report is a no-op.
+func newProgressReporter(mode string, interval time.Duration) (*ProgressReporter, error) {
+	switch mode {
+	case "auto":
+		mode = "tty"
+		if !isTerminal(os.Stderr) {
+			mode = "json"
+		}
+	case "tty", "json", "none":
+	default:
+		return nil, fmt.Errorf("unknown -progress %q (want auto, tty, json or none)", mode)
+	}
+
+	return &ProgressReporter{none: mode == "none", json: mode == "json", interval: interval}, nil
+}
+
+// Report records one progress update and, depending on the reporter's mode
+// and -progress-interval, prints it.
+func (p *ProgressReporter) Report(u ProgressUpdate) {
+	if p.none {
+		return
+	}
+
+	now := time.Now()
+
+	if !p.lastSample.IsZero() {
+		if dt := now.Sub(p.lastSample).Seconds(); dt > 0 {
+			p.byteRate = smooth(p.byteRate, float64(u.ReadBytes-p.lastBytes)/dt)
+			p.rowRate = smooth(p.rowRate, float64(u.ReadRows-p.lastRows)/dt)
+		}
+	}
+	p.lastBytes, p.lastRows, p.lastSample = u.ReadBytes, u.ReadRows, now
+
+	if p.interval > 0 && now.Sub(p.lastPrint) < p.interval {
+		return
+	}
+	p.lastPrint = now
+
+	if p.json {
+		p.printJSON(u)
+	} else {
+		p.printTTY(u)
+	}
+}
+
+// Done clears the TTY progress line, if one was being drawn.
+func (p *ProgressReporter) Done() {
+	if !p.none && !p.json {
+		fmt.Fprint(os.Stderr, clearLine)
+	}
+}
+
+// smooth applies exponential smoothing so the displayed rate doesn't jump
+// around with every (possibly bursty) progress sample.
+func smooth(prev, sample float64) float64 {
+	const alpha = 0.3
+	if prev == 0 {
+		return sample
+	}
+	return alpha*sample + (1-alpha)*prev
+}
+
+func (p *ProgressReporter) printTTY(u ProgressUpdate) {
+	pct := 0.0
+	if u.TotalRows > 0 {
+		pct = float64(u.ReadRows) / float64(u.TotalRows) * 100
+	}
+
+	eta := "?"
+	if p.rowRate > 0 && u.TotalRows > u.ReadRows {
+		eta = time.Duration(float64(u.TotalRows-u.ReadRows)/p.rowRate*float64(time.Second)).Round(time.Second).String()
+	}
+
+	fmt.Fprintf(os.Stderr, "%sProgress: %.0f%% (%s read, %s/sec, %s/sec, ETA %s)",
+		clearLine, pct, formatBytesIEC(u.ReadBytes), formatBytesIEC(int64(p.byteRate)), formatRowsSI(p.rowRate), eta)
+}
+
+func (p *ProgressReporter) printJSON(u ProgressUpdate) {
+	rec := struct {
+		ReadRows  int64   `json:"read_rows"`
+		ReadBytes int64   `json:"read_bytes"`
+		TotalRows int64   `json:"total_rows"`
+		BytesSec  float64 `json:"bytes_per_sec"`
+		RowsSec   float64 `json:"rows_per_sec"`
+	}{u.ReadRows, u.ReadBytes, u.TotalRows, p.byteRate, p.rowRate}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(os.Stderr, string(data))
+}
+
+// formatBytesIEC renders n using IEC binary units, e.g. "1.24 GiB".
+func formatBytesIEC(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatRowsSI renders a row count/rate using SI units, e.g. "3.4 M rows".
+func formatRowsSI(n float64) string {
+	const unit = 1000.0
+	if n < unit {
+		return fmt.Sprintf("%.0f rows", n)
+	}
+	units := "KMGTPE"
+	exp := -1
+	for v := n; v >= unit && exp < len(units)-1; v /= unit {
+		exp++
+	}
+	return fmt.Sprintf("%.1f %c rows", n/pow(unit, exp+1), units[exp])
+}
+
+func pow(base float64, exp int) float64 {
+	res := 1.0
+	for i := 0; i < exp; i++ {
+		res *= base
+	}
+	return res
+}
@@ -0,0 +1,100 @@
+package main
+
+import "encoding/binary"
+
+// A small, pure-Go implementation of 64-bit xxHash (XXH64), vendored rather
+// than pulled in as a module dependency since this is the only piece of it
+// logscli needs. Sum64/Sum64String are shared by dedup (-dedup) and sampling
+// (-sample) so both key off the same hash of the non-timestamp columns.
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// Sum64 returns the 64-bit xxHash of data, using seed 0.
+func Sum64(data []byte) uint64 {
+	return Sum64Seed(data, 0)
+}
+
+// Sum64String returns the 64-bit xxHash of s, using seed 0; s is converted
+// to a []byte first.
+func Sum64String(s string) uint64 {
+	return Sum64Seed([]byte(s), 0)
+}
+
+// Sum64Seed returns the 64-bit xxHash of data for the given seed.
+func Sum64Seed(data []byte, seed uint64) uint64 {
+	n := len(data)
+	var h uint64
+	i := 0
+
+	if n >= 32 {
+		v1 := seed + xxPrime1 + xxPrime2
+		v2 := seed + xxPrime2
+		v3 := seed
+		v4 := seed - xxPrime1
+
+		for ; i+32 <= n; i += 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(data[i:]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(data[i+8:]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(data[i+16:]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(data[i+24:]))
+		}
+
+		h = rotl64(v1, 1) + rotl64(v2, 7) + rotl64(v3, 12) + rotl64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = seed + xxPrime5
+	}
+
+	h += uint64(n)
+
+	for ; i+8 <= n; i += 8 {
+		k1 := xxRound(0, binary.LittleEndian.Uint64(data[i:]))
+		h ^= k1
+		h = rotl64(h, 27)*xxPrime1 + xxPrime4
+	}
+
+	if i+4 <= n {
+		h ^= uint64(binary.LittleEndian.Uint32(data[i:])) * xxPrime1
+		h = rotl64(h, 23)*xxPrime2 + xxPrime3
+		i += 4
+	}
+
+	for ; i < n; i++ {
+		h ^= uint64(data[i]) * xxPrime5
+		h = rotl64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = rotl64(acc, 31)
+	acc *= xxPrime1
+	return acc
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	val = xxRound(0, val)
+	acc ^= val
+	acc = acc*xxPrime1 + xxPrime4
+	return acc
+}
+
+func rotl64(x uint64, r uint) uint64 {
+	return (x << r) | (x >> (64 - r))
+}